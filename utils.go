@@ -4,14 +4,66 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"index/suffixarray"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sync"
 	"time"
 )
 
+// debugFlag toggles Debugf output and is set once at startup from the
+// DOCKER_DEBUG environment variable.
+var debugFlag = os.Getenv("DOCKER_DEBUG") != ""
+
+// logBufSize caps how much log history a newly attached client is replayed.
+// Debugf/Infof/Errorf run for the lifetime of the daemon, so the generic
+// defaultBufSize (sized for a single attach/logs stream) would otherwise
+// resend an ever-growing chunk of history to every client that subscribes.
+const logBufSize = 64 * 1024 // 64KB, about the last few hundred lines
+
+// logBroadcaster fans every Debugf/Infof/Errorf line out to stderr and to
+// any client socket attached with AttachLog, so a daemon running with a
+// remote client can stream the same log output it prints locally.
+var logBroadcaster = newWriteBroadcaster()
+
+func init() {
+	logBroadcaster.bufSize = logBufSize
+	logBroadcaster.AddWriter(NopWriteCloser(os.Stderr))
+}
+
+// AttachLog subscribes writer to the package's log output. Callers are
+// responsible for eventually calling RemoveWriter to detach it.
+func AttachLog(writer io.WriteCloser) {
+	logBroadcaster.AddWriter(writer)
+}
+
+func Debugf(format string, a ...interface{}) {
+	if debugFlag {
+		logf("DEBUG", format, a...)
+	}
+}
+
+func Infof(format string, a ...interface{}) {
+	logf("INFO", format, a...)
+}
+
+func Errorf(format string, a ...interface{}) {
+	logf("ERROR", format, a...)
+}
+
+func logf(level, format string, a ...interface{}) {
+	file, line := "???", 0
+	if _, f, l, ok := runtime.Caller(2); ok {
+		file, line = filepath.Base(f), l
+	}
+	fmt.Fprintf(logBroadcaster, "[%s] %s:%d %s\n", level, file, line, fmt.Sprintf(format, a...))
+}
+
 // HumanDuration returns a human-readable approximation of a duration
 // (eg. "About a minute", "4 hours ago", etc.)
 func HumanDuration(d time.Duration) string {
@@ -57,6 +109,111 @@ func SelfPath() string {
 	return path
 }
 
+// Go is a basic promise implementation: it wraps calls a function in a goroutine,
+// and returns a channel which will later return the function's return value.
+func Go(f func() error) chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- f()
+	}()
+	return ch
+}
+
+// Request a given URL and return the *http.Response, whose Body the caller
+// must close. Responses with a status code >= 400 are returned as an error.
+func Download(url string) (*http.Response, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Got HTTP status code >= 400: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// progressUpdateInterval caps how often updateProgress writes an intermediate
+// progress line to Output, so a fast stream doesn't flood attached clients with a line per
+// Read call.
+const progressUpdateInterval = 100 * time.Millisecond
+
+// ProgressReader wraps an io.ReadCloser, counting the bytes read from it and
+// periodically writing a human-readable progress line to Output, so that
+// long-running transfers (eg. pulling an image layer) can report their
+// status to one or more attached clients.
+type ProgressReader struct {
+	reader     io.ReadCloser // Stream to read from
+	Output     io.Writer     // Where to send progress updates
+	total      int64         // Expected stream length, 0 if unknown
+	progress   int64         // How much has been read so far
+	start      time.Time     // When the read began, used for the ETA
+	lastUpdate time.Time     // When a progress line was last written
+	completed  bool          // Whether the 100% line has already been emitted
+}
+
+func NewProgressReader(r io.ReadCloser, total int64, output io.Writer) *ProgressReader {
+	return &ProgressReader{
+		reader: r,
+		Output: output,
+		total:  total,
+		start:  time.Now(),
+	}
+}
+
+func (r *ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.progress += int64(n)
+	r.updateProgress(err)
+	return n, err
+}
+
+// updateProgress writes a progress line to Output. Intermediate lines are
+// throttled to at most once per progressUpdateInterval; the final line, on
+// completion or on a read error, is written regardless. A 100% line is only ever emitted once the
+// stream has actually completed (io.EOF, or progress caught up with total);
+// any other read error just flushes the last known progress, without
+// falsely claiming success.
+func (r *ProgressReader) updateProgress(err error) {
+	if r.Output == nil {
+		return
+	}
+	complete := err == io.EOF || (r.total > 0 && r.progress >= r.total)
+	failed := err != nil && err != io.EOF
+	if complete && r.completed {
+		// Already reported completion; nothing left to say.
+		return
+	}
+	if !complete && !failed && time.Since(r.lastUpdate) < progressUpdateInterval {
+		return
+	}
+	r.lastUpdate = time.Now()
+	switch {
+	case complete && r.total > 0:
+		fmt.Fprintf(r.Output, "100%% (%d/%d bytes)", r.total, r.total)
+		r.completed = true
+	case r.total <= 0:
+		fmt.Fprintf(r.Output, "%d bytes", r.progress)
+	default:
+		percentage := int(float64(r.progress) / float64(r.total) * 100)
+		remaining := "n/a"
+		if elapsed := time.Since(r.start); r.progress > 0 {
+			eta := time.Duration(float64(elapsed) * float64(r.total-r.progress) / float64(r.progress))
+			remaining = HumanDuration(eta)
+		}
+		fmt.Fprintf(r.Output, "%d%% (%d/%d bytes) %s left", percentage, r.progress, r.total, remaining)
+	}
+	if complete || failed {
+		fmt.Fprintf(r.Output, "\n")
+	} else {
+		fmt.Fprintf(r.Output, "\r")
+	}
+}
+
+func (r *ProgressReader) Close() error {
+	return r.reader.Close()
+}
+
 type nopWriteCloser struct {
 	io.Writer
 }
@@ -127,15 +284,31 @@ func (r *bufReader) Close() error {
 	return closer.Close()
 }
 
+// defaultBufSize bounds how much of a writeBroadcaster's output is retained
+// for replay to newly attached writers. Older bytes are dropped as new ones
+// come in, so a long-lived stream doesn't grow the backlog without limit.
+const defaultBufSize = 1 << 20 // 1MB
+
 type writeBroadcaster struct {
+	l       sync.Mutex
+	buf     *bytes.Buffer
+	bufSize int
 	writers *list.List
 }
 
 func (w *writeBroadcaster) AddWriter(writer io.WriteCloser) {
+	w.l.Lock()
+	defer w.l.Unlock()
 	w.writers.PushBack(writer)
+	// Replay everything still in the backlog so the new writer doesn't miss it
+	if w.buf.Len() > 0 {
+		writer.Write(w.buf.Bytes())
+	}
 }
 
 func (w *writeBroadcaster) RemoveWriter(writer io.WriteCloser) {
+	w.l.Lock()
+	defer w.l.Unlock()
 	for e := w.writers.Front(); e != nil; e = e.Next() {
 		v := e.Value.(io.Writer)
 		if v == writer {
@@ -146,6 +319,10 @@ func (w *writeBroadcaster) RemoveWriter(writer io.WriteCloser) {
 }
 
 func (w *writeBroadcaster) Write(p []byte) (n int, err error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.buf.Write(p)
+	w.trimBuf()
 	failed := []*list.Element{}
 	for e := w.writers.Front(); e != nil; e = e.Next() {
 		writer := e.Value.(io.Writer)
@@ -162,6 +339,35 @@ func (w *writeBroadcaster) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// trimBuf drops the oldest bytes in the backlog once it grows past bufSize.
+// Callers must hold w.l.
+func (w *writeBroadcaster) trimBuf() {
+	if w.bufSize <= 0 {
+		return
+	}
+	if extra := w.buf.Len() - w.bufSize; extra > 0 {
+		w.buf.Next(extra)
+	}
+}
+
+// AttachReader drains r in a new goroutine, broadcasting every chunk read to
+// the attached writers as it arrives.
+func (w *writeBroadcaster) AttachReader(r io.Reader) {
+	go func() {
+		io.Copy(w, r)
+	}()
+}
+
+// Pipe creates a writeBroadcaster which immediately starts draining r,
+// broadcasting each chunk live to any writer added with AddWriter. Writers
+// added after some of r has already been read are replayed the backlog
+// (bounded to defaultBufSize) before the live stream continues.
+func Pipe(r io.Reader) *writeBroadcaster {
+	writer := newWriteBroadcaster()
+	writer.AttachReader(r)
+	return writer
+}
+
 func (w *writeBroadcaster) Close() error {
 	for e := w.writers.Front(); e != nil; e = e.Next() {
 		writer := e.Value.(io.WriteCloser)
@@ -171,5 +377,211 @@ func (w *writeBroadcaster) Close() error {
 }
 
 func newWriteBroadcaster() *writeBroadcaster {
-	return &writeBroadcaster{list.New()}
+	return &writeBroadcaster{buf: &bytes.Buffer{}, bufSize: defaultBufSize, writers: list.New()}
+}
+
+// TruncIndex allows the retrieval of strings (typically container or image
+// IDs) by any of their unique prefixes, using a suffix array over the full
+// corpus for O(log n) lookups instead of a linear scan.
+type TruncIndex struct {
+	sync.RWMutex
+	ids   map[string]bool
+	bytes []byte
+	index *suffixarray.Index
+}
+
+func NewTruncIndex(ids []string) *TruncIndex {
+	index := &TruncIndex{
+		ids:   make(map[string]bool),
+		bytes: []byte{'\n'},
+	}
+	for _, id := range ids {
+		index.ids[id] = true
+		index.bytes = append(index.bytes, []byte(id+"\n")...)
+	}
+	index.index = suffixarray.New(index.bytes)
+	return index
+}
+
+func (idx *TruncIndex) Add(id string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	if _, exists := idx.ids[id]; exists {
+		return fmt.Errorf("id already exists: %s", id)
+	}
+	idx.ids[id] = true
+	idx.bytes = append(idx.bytes, []byte(id+"\n")...)
+	idx.index = suffixarray.New(idx.bytes)
+	return nil
+}
+
+func (idx *TruncIndex) Delete(id string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	if _, exists := idx.ids[id]; !exists {
+		return fmt.Errorf("no such id: %s", id)
+	}
+	delete(idx.ids, id)
+	idx.bytes = bytes.Replace(idx.bytes, []byte("\n"+id+"\n"), []byte("\n"), 1)
+	idx.index = suffixarray.New(idx.bytes)
+	return nil
+}
+
+// Get returns the full id matched by prefix, or an error if the prefix
+// matches no id (not found) or more than one id (ambiguous).
+func (idx *TruncIndex) Get(prefix string) (string, error) {
+	idx.RLock()
+	defer idx.RUnlock()
+	offsets := idx.index.Lookup([]byte("\n"+prefix), -1)
+	if len(offsets) == 0 {
+		return "", fmt.Errorf("no such id: %s", prefix)
+	}
+	ids := make(map[string]bool)
+	for _, offset := range offsets {
+		start := offset + 1
+		end := bytes.IndexByte(idx.bytes[start:], '\n')
+		if end == -1 {
+			continue
+		}
+		ids[string(idx.bytes[start:start+end])] = true
+	}
+	if len(ids) > 1 {
+		return "", fmt.Errorf("multiple ids found with prefix: %s", prefix)
+	}
+	for id := range ids {
+		return id, nil
+	}
+	return "", fmt.Errorf("no such id: %s", prefix)
+}
+
+// AtomicFileWriter writes to a temp file in the same directory as path and,
+// on Close, fsyncs and renames it into place so that readers never observe
+// a partially-written file. Call Abort instead of Close to discard the
+// write without touching path.
+type AtomicFileWriter struct {
+	f    *os.File
+	path string
+	done bool
+}
+
+func NewAtomicFileWriter(path string, perm os.FileMode) (*AtomicFileWriter, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &AtomicFileWriter{f: f, path: path}, nil
+}
+
+func (w *AtomicFileWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *AtomicFileWriter) Close() error {
+	if err := w.syncAndClose(); err != nil {
+		return err
+	}
+	if err := w.rename(); err != nil {
+		return err
+	}
+	w.done = true
+	return nil
+}
+
+// syncAndClose fsyncs and closes the temp file, without renaming it into
+// place yet. On failure the temp file is removed.
+func (w *AtomicFileWriter) syncAndClose() error {
+	if err := w.f.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+// rename publishes an already-synced-and-closed temp file to its final path.
+func (w *AtomicFileWriter) rename() error {
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort discards the temp file without renaming it into place.
+func (w *AtomicFileWriter) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// AtomicWriteSet groups several AtomicFileWriters so that data written
+// alongside an index (eg. a tar layer and its checksum sidecar) can be
+// committed or rolled back together, the way a packfile and its index are
+// only made visible once both are known good.
+type AtomicWriteSet struct {
+	writers []*AtomicFileWriter
+}
+
+func NewAtomicWriteSet() *AtomicWriteSet {
+	return &AtomicWriteSet{}
+}
+
+// NewFile opens an AtomicFileWriter for path and adds it to the set.
+func (s *AtomicWriteSet) NewFile(path string, perm os.FileMode) (*AtomicFileWriter, error) {
+	w, err := NewAtomicFileWriter(path, perm)
+	if err != nil {
+		return nil, err
+	}
+	s.writers = append(s.writers, w)
+	return w, nil
+}
+
+// Commit is two-phase: every writer is first fsynced and closed to its temp
+// file, and only once *all* of them are durable does any rename happen. If
+// staging fails partway through, every writer (staged or not) is aborted
+// and nothing is renamed, so the set never leaves one file visible without
+// the others it belongs with (eg. a layer tar without its checksum
+// sidecar). A failure during the rename phase itself can't be undone -
+// renames already performed are left in place - but by then every file is
+// known good, so only the rename syscall itself is at risk.
+func (s *AtomicWriteSet) Commit() error {
+	for i, w := range s.writers {
+		if err := w.syncAndClose(); err != nil {
+			for _, staged := range s.writers[:i] {
+				os.Remove(staged.f.Name())
+			}
+			for _, unstaged := range s.writers[i+1:] {
+				unstaged.Abort()
+			}
+			return err
+		}
+	}
+	for _, w := range s.writers {
+		if err := w.rename(); err != nil {
+			return err
+		}
+		w.done = true
+	}
+	return nil
+}
+
+// Cancel aborts every writer in the set that has not yet been committed.
+func (s *AtomicWriteSet) Cancel() error {
+	var firstErr error
+	for _, w := range s.writers {
+		if w.done {
+			continue
+		}
+		if err := w.Abort(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
@@ -0,0 +1,285 @@
+package docker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeReader feeds a fixed sequence of chunks and then returns err forever.
+type fakeReader struct {
+	chunks [][]byte
+	err    error
+	i      int
+}
+
+func (f *fakeReader) Read(p []byte) (int, error) {
+	if f.i >= len(f.chunks) {
+		return 0, f.err
+	}
+	n := copy(p, f.chunks[f.i])
+	f.i++
+	return n, nil
+}
+
+func (f *fakeReader) Close() error { return nil }
+
+func TestProgressReaderErrorDoesNotReport100Percent(t *testing.T) {
+	errBoom := errors.New("boom")
+	src := &fakeReader{chunks: [][]byte{make([]byte, 50)}, err: errBoom}
+	var out bytes.Buffer
+	r := NewProgressReader(src, 100, &out)
+	buf := make([]byte, 64)
+
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("unexpected error on first read: %v", err)
+	}
+	if _, err := r.Read(buf); err != errBoom {
+		t.Fatalf("expected sentinel error, got %v", err)
+	}
+	if strings.Contains(out.String(), "100%") {
+		t.Fatalf("progress output should not report 100%% on a non-EOF error, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "50%") {
+		t.Fatalf("expected the last known percentage to be flushed, got %q", out.String())
+	}
+}
+
+func TestProgressReaderThrottlesUpdates(t *testing.T) {
+	src := &fakeReader{chunks: [][]byte{{1}, {2}, {3}}, err: io.EOF}
+	var out bytes.Buffer
+	r := NewProgressReader(src, 1000, &out)
+	buf := make([]byte, 1)
+
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("unexpected error on first read: %v", err)
+	}
+	before := out.Len()
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("unexpected error on second read: %v", err)
+	}
+	if out.Len() != before {
+		t.Fatalf("expected a read within progressUpdateInterval to be throttled, got extra output %q", out.String()[before:])
+	}
+}
+
+func TestProgressReaderEmits100PercentOnce(t *testing.T) {
+	src := &fakeReader{chunks: [][]byte{make([]byte, 10)}, err: io.EOF}
+	var out bytes.Buffer
+	r := NewProgressReader(src, 10, &out)
+	buf := make([]byte, 10)
+
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("unexpected error on first read: %v", err)
+	}
+	first := out.String()
+	if strings.Count(first, "100%") != 1 {
+		t.Fatalf("expected exactly one 100%% line, got %q", first)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if out.String() != first {
+		t.Fatalf("expected no further output once 100%% has already been reported, got %q", out.String())
+	}
+}
+
+func TestTruncIndexGet(t *testing.T) {
+	id := "99999999999999999999999999999999999999999999999999999999999999"
+	index := NewTruncIndex(nil)
+	if err := index.Add(id); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := index.Get("9999"); err != nil || got != id {
+		t.Fatalf("Get(\"9999\") = %q, %v; want %q, nil", got, err, id)
+	}
+	if got, err := index.Get(id); err != nil || got != id {
+		t.Fatalf("Get(full id) = %q, %v; want %q, nil", got, err, id)
+	}
+}
+
+func TestTruncIndexAmbiguous(t *testing.T) {
+	ids := []string{
+		"99999999999999999999999999999999999999999999999999999999999999",
+		"99988888888888888888888888888888888888888888888888888888888888",
+	}
+	index := NewTruncIndex(ids)
+	if _, err := index.Get("999"); err == nil {
+		t.Fatal("expected an ambiguous prefix to return an error")
+	}
+	if got, err := index.Get("99999"); err != nil || got != ids[0] {
+		t.Fatalf("Get(\"99999\") = %q, %v; want %q, nil", got, err, ids[0])
+	}
+}
+
+func TestTruncIndexNotFound(t *testing.T) {
+	index := NewTruncIndex(nil)
+	if _, err := index.Get("deadbeef"); err == nil {
+		t.Fatal("expected lookup of an unknown prefix to return an error")
+	}
+}
+
+func TestTruncIndexDelete(t *testing.T) {
+	id := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	index := NewTruncIndex([]string{id})
+	if err := index.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Get("aaaa"); err == nil {
+		t.Fatal("expected lookup after delete to return an error")
+	}
+	if err := index.Delete(id); err == nil {
+		t.Fatal("expected deleting an already-deleted id to return an error")
+	}
+}
+
+func TestLogfCapturesLevelAndCaller(t *testing.T) {
+	var out bytes.Buffer
+	writer := NopWriteCloser(&out)
+	AttachLog(writer) // replays any prior backlog into out before we start asserting
+	defer logBroadcaster.RemoveWriter(writer)
+
+	before := out.Len()
+	Infof("hello %s", "world")
+	got := out.String()[before:]
+
+	if !strings.Contains(got, "[INFO] utils_test.go:") {
+		t.Fatalf("expected log line to include level and caller file:line, got %q", got)
+	}
+	if !strings.Contains(got, "hello world") {
+		t.Fatalf("expected log line to include the formatted message, got %q", got)
+	}
+}
+
+func TestDebugfGatedByDebugFlag(t *testing.T) {
+	var out bytes.Buffer
+	writer := NopWriteCloser(&out)
+	AttachLog(writer) // replays any prior backlog into out before we start asserting
+
+	saved := debugFlag
+	defer func() { debugFlag = saved }()
+
+	debugFlag = false
+	before := out.Len()
+	Debugf("should not appear")
+	if out.Len() != before {
+		t.Fatalf("expected Debugf to be suppressed when debugFlag is false, got extra output %q", out.String()[before:])
+	}
+	logBroadcaster.RemoveWriter(writer)
+
+	writer = NopWriteCloser(&out)
+	AttachLog(writer)
+	defer logBroadcaster.RemoveWriter(writer)
+	before = out.Len()
+	debugFlag = true
+	Debugf("should appear")
+	added := out.String()[before:]
+	if !strings.Contains(added, "[DEBUG]") || !strings.Contains(added, "should appear") {
+		t.Fatalf("expected Debugf output once debugFlag is true, got %q", added)
+	}
+}
+
+func TestLogBroadcasterBufSize(t *testing.T) {
+	if logBroadcaster.bufSize != logBufSize {
+		t.Fatalf("logBroadcaster.bufSize = %d, want %d", logBroadcaster.bufSize, logBufSize)
+	}
+}
+
+func TestWriteBroadcasterBoundedReplay(t *testing.T) {
+	w := newWriteBroadcaster()
+	w.bufSize = 16 // small cap so the test doesn't need to write megabytes
+
+	w.Write([]byte("0123456789"))
+	w.Write([]byte("abcdefghij")) // 20 bytes written, past the 16-byte cap
+
+	var late bytes.Buffer
+	w.AddWriter(NopWriteCloser(&late))
+
+	want := "456789abcdefghij" // the last bufSize bytes of the stream so far
+	if got := late.String(); got != want {
+		t.Fatalf("replayed backlog = %q, want %q", got, want)
+	}
+
+	// A writer attached mid-stream should also keep receiving live writes.
+	w.Write([]byte("!"))
+	if got := late.String(); got != want+"!" {
+		t.Fatalf("after attach, live write = %q, want %q", got, want+"!")
+	}
+}
+
+func TestAtomicWriteSetCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-atomicwriteset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	set := NewAtomicWriteSet()
+	layer, err := set.NewFile(filepath.Join(dir, "layer.tar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.Write([]byte("layer contents"))
+
+	sum, err := set.NewFile(filepath.Join(dir, "layer.tar.sha256"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum.Write([]byte("deadbeef"))
+
+	if err := set.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"layer.tar":        "layer contents",
+		"layer.tar.sha256": "deadbeef",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAtomicWriteSetRollsBackOnStagingFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-atomicwriteset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	set := NewAtomicWriteSet()
+	layer, err := set.NewFile(filepath.Join(dir, "layer.tar"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.Write([]byte("layer contents"))
+
+	sum, err := set.NewFile(filepath.Join(dir, "layer.tar.sha256"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum.Write([]byte("deadbeef"))
+	// Force the checksum writer's staging step to fail, simulating a
+	// failure partway through a multi-file commit.
+	sum.f.Close()
+
+	if err := set.Commit(); err == nil {
+		t.Fatal("expected Commit to fail when a writer can't be staged")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "layer.tar")); !os.IsNotExist(err) {
+		t.Fatalf("layer.tar should not have been published after a failed commit, stat err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "layer.tar.sha256")); !os.IsNotExist(err) {
+		t.Fatalf("layer.tar.sha256 should not have been published after a failed commit, stat err=%v", err)
+	}
+}